@@ -19,13 +19,23 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"flag"
 	"fmt"
 	"log"
+	"math/big"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -33,17 +43,59 @@ import (
 )
 
 var (
-	doTCP  bool
-	doUDP  bool
-	doHTTP bool
-	port   int
+	doTCP    bool
+	doUDP    bool
+	doHTTP   bool
+	doHTTPS  bool
+	doSOCKS5 bool
+	doSTUN   bool
+	port     int
+
+	tcpPort    int
+	udpPort    int
+	httpPort   int
+	httpsPort  int
+	socks5Port int
+
+	certFile string
+	keyFile  string
+
+	socks5User string
+	socks5Pass string
+
+	httpReadTimeout  time.Duration
+	httpWriteTimeout time.Duration
+	httpIdleTimeout  time.Duration
+
+	shutdownGrace    time.Duration
+	preshutdownDelay time.Duration
+
+	wsInterval time.Duration
 )
 
 func init() {
 	flag.BoolVar(&doTCP, "tcp", false, "serve raw over TCP")
 	flag.BoolVar(&doUDP, "udp", false, "serve raw over UDP")
 	flag.BoolVar(&doHTTP, "http", false, "serve HTTP")
-	flag.IntVar(&port, "port", 9376, "port number")
+	flag.BoolVar(&doHTTPS, "https", false, "serve HTTPS")
+	flag.BoolVar(&doSOCKS5, "socks5", false, "serve a SOCKS5 proxy")
+	flag.BoolVar(&doSTUN, "stun", false, "answer RFC 5389 STUN Binding requests on the UDP listener")
+	flag.IntVar(&port, "port", 9376, "port number used for any protocol whose own port flag is unset")
+	flag.IntVar(&tcpPort, "tcp-port", 0, "port number for TCP (default: -port)")
+	flag.IntVar(&udpPort, "udp-port", 0, "port number for UDP (default: -port)")
+	flag.IntVar(&httpPort, "http-port", 0, "port number for HTTP (default: -port)")
+	flag.IntVar(&httpsPort, "https-port", 0, "port number for HTTPS (default: -port, or -port+1 if -http is also enabled)")
+	flag.IntVar(&socks5Port, "socks5-port", 0, "port number for the SOCKS5 proxy (default: -port)")
+	flag.StringVar(&certFile, "cert", "", "path to a TLS certificate (PEM); if unset, a self-signed cert is generated")
+	flag.StringVar(&keyFile, "key", "", "path to a TLS private key (PEM); if unset, a self-signed cert is generated")
+	flag.StringVar(&socks5User, "socks5-user", "", "if set (with -socks5-pass), require SOCKS5 USERNAME/PASSWORD auth")
+	flag.StringVar(&socks5Pass, "socks5-pass", "", "if set (with -socks5-user), require SOCKS5 USERNAME/PASSWORD auth")
+	flag.DurationVar(&httpReadTimeout, "http-read-timeout", 0, "ReadTimeout for the HTTP(S) servers (0 means no timeout)")
+	flag.DurationVar(&httpWriteTimeout, "http-write-timeout", 0, "WriteTimeout for the HTTP(S) servers (0 means no timeout)")
+	flag.DurationVar(&httpIdleTimeout, "http-idle-timeout", 0, "IdleTimeout for the HTTP(S) servers (0 means no timeout)")
+	flag.DurationVar(&shutdownGrace, "shutdown-grace", 30*time.Second, "how long to wait for in-flight requests to finish on SIGTERM")
+	flag.DurationVar(&preshutdownDelay, "preshutdown-delay", 0, "how long to fail readyz while still serving, before draining on SIGTERM")
+	flag.DurationVar(&wsInterval, "ws-interval", time.Second, "interval between heartbeat frames sent on the HTTP listener's /ws endpoint")
 }
 
 func main() {
@@ -60,11 +112,33 @@ func main() {
 
 	flag.Parse()
 
-	if !doHTTP && !doTCP && !doUDP {
+	if doSTUN {
+		// -stun only has an effect on the UDP listener.
+		doUDP = true
+	}
+	if !doHTTP && !doHTTPS && !doTCP && !doUDP && !doSOCKS5 {
 		doHTTP = true
 	}
-	if doHTTP && (doTCP || doUDP) {
-		log.Fatalf("can't serve TCP/UDP mode and HTTP mode at the same time")
+	if tcpPort == 0 {
+		tcpPort = port
+	}
+	if udpPort == 0 {
+		udpPort = port
+	}
+	if httpPort == 0 {
+		httpPort = port
+	}
+	if httpsPort == 0 {
+		httpsPort = port
+		if doHTTP {
+			// -http and -https are commonly enabled together; give HTTPS a
+			// distinct default port so that combo works without requiring
+			// -https-port to be set explicitly.
+			httpsPort = port + 1
+		}
+	}
+	if socks5Port == 0 {
+		socks5Port = port
 	}
 
 	hostname, err := os.Hostname()
@@ -72,80 +146,292 @@ func main() {
 		log.Fatalf("error from os.Hostname(): %s", err)
 	}
 
+	// Listener goroutines report fatal errors here instead of calling
+	// log.Fatalf, so a failure on one protocol doesn't take down the others.
+	errs := make(chan error, 5)
+
+	// ready flips to false the moment SIGTERM is received, so /readyz can
+	// fail fast and let Kubernetes pull the pod from service endpoints.
+	// alive stays true until the shutdown sequence below has fully drained,
+	// so /livez doesn't trip a liveness restart mid-drain.
+	var ready, alive, shuttingDown atomic.Bool
+	ready.Store(true)
+	alive.Store(true)
+
+	var tcpListener net.Listener
+	var udpSock *net.UDPConn
+	var httpSrv, httpsSrv *http.Server
+
 	if doTCP {
-		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", tcpPort))
 		if err != nil {
-			log.Fatalf("Listen(): %s", err)
-		}
-		go func() {
-			log.Printf("serving TCP on port %d", port)
-			for {
-				conn, err := listener.Accept()
-				if err != nil {
-					log.Fatalf("Accept(): %s", err)
+			errs <- fmt.Errorf("TCP Listen(): %w", err)
+		} else {
+			tcpListener = listener
+			go func() {
+				log.Printf("serving TCP on port %d", tcpPort)
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						if shuttingDown.Load() {
+							return
+						}
+						errs <- fmt.Errorf("TCP Accept(): %w", err)
+						return
+					}
+					client := conn.RemoteAddr().String()
+					log.Printf("TCP request from %s", client)
+					conn.Write([]byte(makeMessage(hostname, client, false)))
+					conn.Close()
 				}
-				client := conn.RemoteAddr().String()
-				log.Printf("TCP request from %s", client)
-				conn.Write([]byte(makeMessage(hostname, client)))
-				conn.Close()
-			}
-		}()
+			}()
+		}
 	}
 	if doUDP {
-		addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", port))
+		addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", udpPort))
 		if err != nil {
-			log.Fatalf("ResolveUDPAddr(): %s", err)
+			errs <- fmt.Errorf("UDP ResolveUDPAddr(): %w", err)
+		} else if sock, err := net.ListenUDP("udp", addr); err != nil {
+			errs <- fmt.Errorf("UDP ListenUDP(): %w", err)
+		} else {
+			udpSock = sock
+			go func() {
+				log.Printf("serving UDP on port %d", udpPort)
+				var buffer [512]byte
+				for {
+					n, cliAddr, err := sock.ReadFrom(buffer[0:])
+					if err != nil {
+						if shuttingDown.Load() {
+							return
+						}
+						errs <- fmt.Errorf("UDP ReadFrom(): %w", err)
+						return
+					}
+					if doSTUN && isSTUNBindingRequest(buffer[:n]) {
+						log.Printf("STUN binding request from %s", cliAddr.String())
+						sock.WriteTo(stunBindingResponse(buffer[:n], cliAddr.(*net.UDPAddr)), cliAddr)
+						continue
+					}
+					log.Printf("UDP request from %s", cliAddr.String())
+					sock.WriteTo([]byte(makeMessage(hostname, cliAddr.String(), false)), cliAddr)
+				}
+			}()
 		}
-		sock, err := net.ListenUDP("udp", addr)
-		if err != nil {
-			log.Fatalf("ListenUDP(): %s", err)
+	}
+	if doHTTP {
+		httpSrv = &http.Server{
+			Addr:         fmt.Sprintf(":%d", httpPort),
+			Handler:      newMux(hostname, false, &ready, &alive, true),
+			ReadTimeout:  httpReadTimeout,
+			WriteTimeout: httpWriteTimeout,
+			IdleTimeout:  httpIdleTimeout,
 		}
 		go func() {
-			log.Printf("serving UDP on port %d", port)
-			var buffer [16]byte
-			for {
-				_, cliAddr, err := sock.ReadFrom(buffer[0:])
-				if err != nil {
-					log.Fatalf("ReadFrom(): %s", err)
-				}
-				log.Printf("UDP request from %s", cliAddr.String())
-				sock.WriteTo([]byte(makeMessage(hostname, cliAddr.String())), cliAddr)
+			log.Printf("serving HTTP on port %d", httpPort)
+			if err := httpSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				errs <- fmt.Errorf("HTTP ListenAndServe(): %w", err)
 			}
 		}()
 	}
-	if doHTTP {
-		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			// Add this header to force to close the connection after serving the request.
-			w.Header().Add("Connection", "close")
+	if doHTTPS {
+		cert, err := loadOrGenerateCert(certFile, keyFile, hostname)
+		if err != nil {
+			log.Fatalf("error loading TLS certificate: %s", err)
+		}
+		logCertFingerprint(cert, certFile == "" && keyFile == "")
 
-			log.Printf("HTTP request from %s", r.RemoteAddr)
-			fmt.Fprintf(w, "%s", makeMessage(hostname, r.RemoteAddr))
-		})
-		go func() {
-			log.Printf("serving HTTP on port %d", port)
-			log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
-		}()
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", httpsPort))
+		if err != nil {
+			errs <- fmt.Errorf("HTTPS Listen(): %w", err)
+		} else {
+			httpsSrv = &http.Server{
+				Handler:      newMux(hostname, true, &ready, &alive, false),
+				TLSConfig:    &tls.Config{Certificates: []tls.Certificate{cert}},
+				ReadTimeout:  httpReadTimeout,
+				WriteTimeout: httpWriteTimeout,
+				IdleTimeout:  httpIdleTimeout,
+			}
+			go func() {
+				log.Printf("serving HTTPS on port %d", httpsPort)
+				if err := httpsSrv.ServeTLS(listener, "", ""); err != nil && err != http.ErrServerClosed {
+					errs <- fmt.Errorf("HTTPS ServeTLS(): %w", err)
+				}
+			}()
+		}
+	}
+	if doSOCKS5 {
+		go serveSOCKS5(socks5Port, socks5User, socks5Pass, errs)
 	}
 
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
 	for {
-		sig := <-signals
-		log.Printf("received signal: %s", sig)
-		switch sig {
-		case syscall.SIGTERM:
-			log.Printf("waiting 60s")
-			go func() {
-				time.Sleep(60 * time.Second)
+		select {
+		case err := <-errs:
+			log.Printf("listener error: %s", err)
+		case sig := <-signals:
+			log.Printf("received signal: %s", sig)
+			switch sig {
+			case syscall.SIGTERM:
+				log.Printf("failing readyz")
+				ready.Store(false)
+				go drain(preshutdownDelay, shutdownGrace, tcpListener, udpSock, httpSrv, httpsSrv, &shuttingDown, &alive)
+			case syscall.SIGINT:
+				log.Printf("exiting immediately")
 				os.Exit(0)
-			}()
-		case syscall.SIGINT:
-			log.Printf("exiting immediately")
-			os.Exit(0)
+			}
 		}
 	}
 }
 
-func makeMessage(hostname, client string) string {
-	return fmt.Sprintf("{\"server\":%q, \"client\":%q}\n", hostname, client)
+// drain implements the graceful-shutdown pipeline for SIGTERM: fail readyz
+// (already done by the caller), optionally hold a preshutdown window while
+// still serving, then stop each listener and wait up to grace for in-flight
+// work to finish before the process exits. livez stays healthy throughout,
+// so a liveness probe doesn't kill the pod mid-drain.
+func drain(preshutdownDelay, grace time.Duration, tcpListener net.Listener, udpSock *net.UDPConn, httpSrv, httpsSrv *http.Server, shuttingDown, alive *atomic.Bool) {
+	if preshutdownDelay > 0 {
+		log.Printf("preshutdown delay: waiting %s before draining", preshutdownDelay)
+		time.Sleep(preshutdownDelay)
+	}
+
+	log.Printf("shutting down, grace period %s", grace)
+	shuttingDown.Store(true)
+
+	// Stop accepting new TCP connections; in-flight conn.Write calls are
+	// made from the accept loop itself and are unaffected by closing the
+	// listener.
+	if tcpListener != nil {
+		tcpListener.Close()
+	}
+
+	// One deadline covers both HTTP servers, so the total wait is bounded by
+	// grace rather than grace per server.
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	if httpSrv != nil {
+		if err := httpSrv.Shutdown(ctx); err != nil {
+			log.Printf("HTTP Shutdown(): %s", err)
+		}
+	}
+	if httpsSrv != nil {
+		if err := httpsSrv.Shutdown(ctx); err != nil {
+			log.Printf("HTTPS Shutdown(): %s", err)
+		}
+	}
+	cancel()
+	if udpSock != nil {
+		// UDP has no "in-flight" notion; give the last reply a moment to hit
+		// the wire before closing the socket out from under it.
+		time.Sleep(time.Second)
+		udpSock.Close()
+	}
+
+	alive.Store(false)
+	os.Exit(0)
+}
+
+// newMux builds the HTTP handlers shared by the HTTP and HTTPS listeners:
+// "/" for the usual hostname/client probe, a /livez, /readyz pair for
+// Kubernetes rolling updates to drain endpoints correctly, and (on the plain
+// HTTP listener only) a /ws echo/heartbeat endpoint.
+func newMux(hostname string, tlsOn bool, ready, alive *atomic.Bool, ws bool) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// Add this header to force to close the connection after serving the request.
+		w.Header().Add("Connection", "close")
+
+		log.Printf("HTTP request from %s", r.RemoteAddr)
+		fmt.Fprintf(w, "%s", makeMessage(hostname, r.RemoteAddr, tlsOn))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeProbeResponse(w, ready.Load())
+	})
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
+		writeProbeResponse(w, alive.Load())
+	})
+	if ws {
+		mux.Handle("/ws", newWSHandler(hostname, wsInterval))
+	}
+	return mux
+}
+
+func writeProbeResponse(w http.ResponseWriter, ok bool) {
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "not ok")
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// loadOrGenerateCert returns the TLS certificate to serve. If certFile and
+// keyFile are both set, it loads them from disk; otherwise it generates an
+// ephemeral self-signed certificate covering the local hostname and
+// addresses.
+func loadOrGenerateCert(certFile, keyFile, hostname string) (tls.Certificate, error) {
+	if certFile != "" && keyFile != "" {
+		return tls.LoadX509KeyPair(certFile, keyFile)
+	}
+	return generateSelfSignedCert(hostname)
+}
+
+// generateSelfSignedCert creates an in-memory ECDSA P-256 keypair and a
+// self-signed certificate valid for about a year, with a CN of hostname and
+// SANs covering the hostname and every non-loopback local IP address.
+func generateSelfSignedCert(hostname string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("GenerateKey(): %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("rand.Int(): %w", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.IsLoopback() {
+				continue
+			}
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ipnet.IP)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("CreateCertificate(): %w", err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        tmpl,
+	}, nil
+}
+
+// logCertFingerprint logs the SHA-256 fingerprint of the leaf certificate so
+// that testers connecting over an untrusted cert can pin it.
+func logCertFingerprint(cert tls.Certificate, selfSigned bool) {
+	sum := sha256.Sum256(cert.Certificate[0])
+	if selfSigned {
+		log.Printf("serving TLS with self-signed cert, SHA-256 fingerprint: %x", sum)
+		return
+	}
+	log.Printf("serving TLS, SHA-256 fingerprint: %x", sum)
+}
+
+func makeMessage(hostname, client string, tlsOn bool) string {
+	return fmt.Sprintf("{\"server\":%q, \"client\":%q, \"tls\":%t}\n", hostname, client, tlsOn)
 }
@@ -0,0 +1,285 @@
+/*
+Copyright 2014 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// A minimal RFC 1928 SOCKS5 proxy, useful for exercising egress rules
+// (NetworkPolicy, service-mesh egress) from the same debugging pod.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+)
+
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthUserPass     = 0x02
+	socks5AuthNoAcceptable = 0xFF
+
+	socks5CmdConnect = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5ReplySucceeded           = 0x00
+	socks5ReplyCommandNotSupported = 0x07
+	socks5ReplyAtypNotSupported    = 0x08
+)
+
+// serveSOCKS5 accepts SOCKS5 connections on socksPort until the listener
+// fails, at which point the error is sent to errs so the caller can keep the
+// rest of the process running.
+func serveSOCKS5(socksPort int, user, pass string, errs chan<- error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", socksPort))
+	if err != nil {
+		errs <- fmt.Errorf("SOCKS5 Listen(): %w", err)
+		return
+	}
+	log.Printf("serving SOCKS5 on port %d", socksPort)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			errs <- fmt.Errorf("SOCKS5 Accept(): %w", err)
+			return
+		}
+		go handleSOCKS5(conn, user, pass)
+	}
+}
+
+func handleSOCKS5(conn net.Conn, user, pass string) {
+	defer conn.Close()
+	client := conn.RemoteAddr().String()
+
+	if err := socks5Negotiate(conn, user, pass); err != nil {
+		log.Printf("SOCKS5 negotiation with %s failed: %s", client, err)
+		return
+	}
+
+	target, err := socks5Connect(conn)
+	if err != nil {
+		log.Printf("SOCKS5 CONNECT from %s failed: %s", client, err)
+		return
+	}
+	defer target.Close()
+
+	log.Printf("SOCKS5 CONNECT %s -> %s", client, target.RemoteAddr())
+
+	sent, recvd := socks5Pipe(conn, target)
+	log.Printf("SOCKS5 %s -> %s closed, %d bytes up / %d bytes down", client, target.RemoteAddr(), sent, recvd)
+}
+
+// socks5Negotiate performs the version/method greeting and, if configured,
+// USERNAME/PASSWORD sub-negotiation per RFC 1929.
+func socks5Negotiate(conn net.Conn, user, pass string) error {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return fmt.Errorf("read greeting: %w", err)
+	}
+	if hdr[0] != socks5Version {
+		return fmt.Errorf("unsupported version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return fmt.Errorf("read methods: %w", err)
+	}
+
+	wantUserPass := user != "" || pass != ""
+	chosen := byte(socks5AuthNoAcceptable)
+	for _, m := range methods {
+		if wantUserPass && m == socks5AuthUserPass {
+			chosen = socks5AuthUserPass
+			break
+		}
+		if !wantUserPass && m == socks5AuthNone {
+			chosen = socks5AuthNone
+			break
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, chosen}); err != nil {
+		return fmt.Errorf("write method selection: %w", err)
+	}
+	if chosen == socks5AuthNoAcceptable {
+		return errors.New("no acceptable authentication method")
+	}
+	if chosen == socks5AuthNone {
+		return nil
+	}
+
+	authHdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, authHdr); err != nil {
+		return fmt.Errorf("read auth header: %w", err)
+	}
+	ulen := make([]byte, authHdr[1])
+	if _, err := io.ReadFull(conn, ulen); err != nil {
+		return fmt.Errorf("read username: %w", err)
+	}
+	plenBuf := make([]byte, 1)
+	if _, err := io.ReadFull(conn, plenBuf); err != nil {
+		return fmt.Errorf("read password length: %w", err)
+	}
+	plen := make([]byte, plenBuf[0])
+	if _, err := io.ReadFull(conn, plen); err != nil {
+		return fmt.Errorf("read password: %w", err)
+	}
+
+	ok := string(ulen) == user && string(plen) == pass
+	status := byte(0x00)
+	if !ok {
+		status = 0x01
+	}
+	if _, err := conn.Write([]byte{0x01, status}); err != nil {
+		return fmt.Errorf("write auth status: %w", err)
+	}
+	if !ok {
+		return errors.New("authentication failed")
+	}
+	return nil
+}
+
+// socks5Connect reads a CONNECT request, dials the target, and replies with
+// success and the bound local address. When it rejects the command or address
+// type, or cannot reach the target, it writes the matching error reply itself
+// and returns a non-nil error; a read error or a wrong version byte returns an
+// error without any reply.
+func socks5Connect(conn net.Conn) (net.Conn, error) {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return nil, fmt.Errorf("read request header: %w", err)
+	}
+	if hdr[0] != socks5Version {
+		return nil, fmt.Errorf("unsupported version %d", hdr[0])
+	}
+	cmd, atyp := hdr[1], hdr[3]
+
+	var host string
+	switch atyp {
+	case socks5AtypIPv4:
+		buf := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, fmt.Errorf("read IPv4 address: %w", err)
+		}
+		host = net.IP(buf).String()
+	case socks5AtypIPv6:
+		buf := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, fmt.Errorf("read IPv6 address: %w", err)
+		}
+		host = net.IP(buf).String()
+	case socks5AtypDomain:
+		lenBuf := make([]byte, 1)
+		if _, err := io.ReadFull(conn, lenBuf); err != nil {
+			return nil, fmt.Errorf("read domain length: %w", err)
+		}
+		buf := make([]byte, lenBuf[0])
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, fmt.Errorf("read domain: %w", err)
+		}
+		host = string(buf)
+	default:
+		socks5Reply(conn, socks5ReplyAtypNotSupported, nil)
+		return nil, fmt.Errorf("unsupported address type %d", atyp)
+	}
+
+	portBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, portBuf); err != nil {
+		return nil, fmt.Errorf("read port: %w", err)
+	}
+	port := binary.BigEndian.Uint16(portBuf)
+
+	if cmd != socks5CmdConnect {
+		socks5Reply(conn, socks5ReplyCommandNotSupported, nil)
+		return nil, fmt.Errorf("unsupported command %d (only CONNECT is supported)", cmd)
+	}
+
+	if atyp == socks5AtypDomain {
+		ips, err := net.LookupIP(host)
+		if err != nil || len(ips) == 0 {
+			socks5Reply(conn, 0x04, nil) // host unreachable
+			return nil, fmt.Errorf("LookupIP(%q): %w", host, err)
+		}
+		host = ips[0].String()
+	}
+
+	raddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(host, fmt.Sprintf("%d", port)))
+	if err != nil {
+		socks5Reply(conn, 0x04, nil) // host unreachable
+		return nil, fmt.Errorf("ResolveTCPAddr(): %w", err)
+	}
+	target, err := net.DialTCP("tcp", nil, raddr)
+	if err != nil {
+		socks5Reply(conn, 0x05, nil) // connection refused
+		return nil, fmt.Errorf("DialTCP(): %w", err)
+	}
+
+	if err := socks5Reply(conn, socks5ReplySucceeded, target.LocalAddr().(*net.TCPAddr)); err != nil {
+		target.Close()
+		return nil, fmt.Errorf("write reply: %w", err)
+	}
+	return target, nil
+}
+
+// socks5Reply writes a SOCKS5 reply. bound may be nil for error replies, in
+// which case the address fields are zeroed.
+func socks5Reply(conn net.Conn, code byte, bound *net.TCPAddr) error {
+	ip := net.IPv4zero
+	port := 0
+	if bound != nil {
+		ip = bound.IP
+		port = bound.Port
+	}
+	ip4 := ip.To4()
+	atyp := byte(socks5AtypIPv4)
+	addr := ip4
+	if ip4 == nil {
+		atyp = socks5AtypIPv6
+		addr = ip.To16()
+	}
+
+	reply := make([]byte, 0, 6+len(addr))
+	reply = append(reply, socks5Version, code, 0x00, atyp)
+	reply = append(reply, addr...)
+	reply = append(reply, byte(port>>8), byte(port))
+
+	_, err := conn.Write(reply)
+	return err
+}
+
+// socks5Pipe copies bytes bidirectionally between client and target until
+// either side closes, and returns the byte counts in each direction.
+func socks5Pipe(client, target net.Conn) (sent, recvd int64) {
+	sentDone := make(chan int64, 1)
+	recvdDone := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(target, client)
+		target.Close()
+		sentDone <- n
+	}()
+	go func() {
+		n, _ := io.Copy(client, target)
+		client.Close()
+		recvdDone <- n
+	}()
+	sent = <-sentDone
+	recvd = <-recvdDone
+	return sent, recvd
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2014 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// A minimal RFC 5389 STUN Binding responder layered on the UDP listener, so
+// off-the-shelf STUN clients can observe the source IP:port as seen from the
+// cluster network (useful for debugging kube-proxy modes and CNI NAT
+// behavior).
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	stunMagicCookie = 0x2112A442
+
+	stunMessageTypeBindingRequest  = 0x0001
+	stunMessageTypeBindingResponse = 0x0101
+
+	stunHeaderLen = 20
+
+	stunAttrXorMappedAddress = 0x0020
+
+	stunFamilyIPv4 = 0x01
+	stunFamilyIPv6 = 0x02
+)
+
+// isSTUNBindingRequest reports whether buf looks like a STUN Binding
+// Request: a 20-byte header with the well-known magic cookie.
+func isSTUNBindingRequest(buf []byte) bool {
+	if len(buf) < stunHeaderLen {
+		return false
+	}
+	msgType := binary.BigEndian.Uint16(buf[0:2])
+	cookie := binary.BigEndian.Uint32(buf[4:8])
+	return msgType == stunMessageTypeBindingRequest && cookie == stunMagicCookie
+}
+
+// stunBindingResponse builds a Binding Success Response carrying an
+// XOR-MAPPED-ADDRESS attribute for addr, echoing the transaction ID from
+// req.
+func stunBindingResponse(req []byte, addr *net.UDPAddr) []byte {
+	transactionID := req[8:stunHeaderLen]
+
+	family := byte(stunFamilyIPv4)
+	ip := addr.IP.To4()
+	if ip == nil {
+		family = stunFamilyIPv6
+		ip = addr.IP.To16()
+	}
+
+	// Per RFC 5389 15.2: the port is XORed with the top 16 bits of the magic
+	// cookie, and the address is XORed with the magic cookie (IPv4) or the
+	// magic cookie followed by the transaction ID (IPv6).
+	xorKey := make([]byte, 16)
+	binary.BigEndian.PutUint32(xorKey[0:4], stunMagicCookie)
+	copy(xorKey[4:], transactionID)
+
+	xport := uint16(addr.Port) ^ uint16(stunMagicCookie>>16)
+	xaddr := make([]byte, len(ip))
+	for i := range ip {
+		xaddr[i] = ip[i] ^ xorKey[i]
+	}
+
+	value := make([]byte, 4+len(xaddr))
+	value[1] = family
+	binary.BigEndian.PutUint16(value[2:4], xport)
+	copy(value[4:], xaddr)
+
+	attr := make([]byte, 4+len(value))
+	binary.BigEndian.PutUint16(attr[0:2], stunAttrXorMappedAddress)
+	binary.BigEndian.PutUint16(attr[2:4], uint16(len(value)))
+	copy(attr[4:], value)
+
+	resp := make([]byte, stunHeaderLen+len(attr))
+	binary.BigEndian.PutUint16(resp[0:2], stunMessageTypeBindingResponse)
+	binary.BigEndian.PutUint16(resp[2:4], uint16(len(attr)))
+	binary.BigEndian.PutUint32(resp[4:8], stunMagicCookie)
+	copy(resp[8:stunHeaderLen], transactionID)
+	copy(resp[stunHeaderLen:], attr)
+
+	return resp
+}
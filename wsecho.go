@@ -0,0 +1,100 @@
+/*
+Copyright 2014 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// A WebSocket echo/heartbeat endpoint, so users can exercise long-lived
+// connection behavior (idle timeouts, sticky sessions, HTTP/1.1 Upgrade
+// handling) through the same ingress/mesh already fronting the HTTP probe.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+type wsFrame struct {
+	Server string `json:"server"`
+	Client string `json:"client"`
+	Seq    int64  `json:"seq"`
+	Ts     int64  `json:"ts"`
+}
+
+// newWSHandler returns a handler for "/ws" that, once connected, sends one
+// JSON frame every interval until the client disconnects, and echoes back
+// any text frame it receives in the meantime. interval is clamped to a
+// minimum of 1ms, since a non-positive value would make time.NewTicker
+// panic.
+func newWSHandler(hostname string, interval time.Duration) websocket.Handler {
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	return func(ws *websocket.Conn) {
+		client := ws.Request().RemoteAddr
+		log.Printf("WS connect from %s", client)
+		defer log.Printf("WS disconnect from %s", client)
+
+		// websocket.Conn isn't safe for concurrent writers, and both the
+		// echo loop below and the heartbeat loop send on it.
+		var sendMu sync.Mutex
+		send := func(msg string) error {
+			sendMu.Lock()
+			defer sendMu.Unlock()
+			return websocket.Message.Send(ws, msg)
+		}
+
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				var msg string
+				if err := websocket.Message.Receive(ws, &msg); err != nil {
+					if err != io.EOF {
+						log.Printf("WS read from %s: %s", client, err)
+					}
+					return
+				}
+				if err := send(msg); err != nil {
+					return
+				}
+			}
+		}()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var seq int64
+		for {
+			select {
+			case <-closed:
+				return
+			case now := <-ticker.C:
+				frame, err := json.Marshal(wsFrame{Server: hostname, Client: client, Seq: seq, Ts: now.Unix()})
+				if err != nil {
+					log.Printf("WS marshal: %s", err)
+					continue
+				}
+				seq++
+				if err := send(string(frame)); err != nil {
+					return
+				}
+			}
+		}
+	}
+}